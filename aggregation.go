@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// StartDailyAggregation launches the background job that keeps daily_stats
+// caught up. It wakes once a minute and (re-)snapshots yesterday, which is
+// cheap since the query is idempotent and yesterday doesn't change once the
+// day has rolled over in UTC.
+func StartDailyAggregation(ctx context.Context, db *sql.DB) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				yesterday := time.Now().UTC().AddDate(0, 0, -1)
+				if err := snapshotDailyStats(ctx, db, yesterday); err != nil {
+					log.Printf("failed to snapshot daily stats for %s: %v", yesterday.Format("2006-01-02"), err)
+				}
+			}
+		}
+	}()
+}
+
+// ReaggregateFrom rebuilds daily_stats for every day from `since` through
+// yesterday (inclusive), for backfills and migrations.
+func ReaggregateFrom(parentCtx context.Context, db *sql.DB, since time.Time) error {
+	ctx, cancel := context.WithTimeout(parentCtx, 5*time.Minute)
+	defer cancel()
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	start := time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.UTC)
+
+	for day := start; !day.After(yesterday); day = day.AddDate(0, 0, 1) {
+		if err := snapshotDailyStats(ctx, db, day); err != nil {
+			return fmt.Errorf("failed to reaggregate %s: %w", day.Format("2006-01-02"), err)
+		}
+	}
+
+	return nil
+}
+
+// snapshotDailyStats computes and idempotently upserts the daily_stats row
+// for the given UTC day, anchoring the 2-day liveness window used elsewhere
+// in this package to the end of that day rather than to time.Now().
+func snapshotDailyStats(ctx context.Context, db *sql.DB, day time.Time) error {
+	dayStr := day.UTC().Format("2006-01-02")
+	endOfDay := dayStr + " 23:59:59"
+	liveSince := day.UTC().AddDate(0, 0, -2).Format("2006-01-02") + " 23:59:59"
+
+	var total int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM instances
+		WHERE first_seen <= ? AND last_seen >= ?
+	`, endOfDay, liveSince).Scan(&total); err != nil {
+		return fmt.Errorf("failed to count total: %w", err)
+	}
+
+	var inactive int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM instances
+		WHERE first_seen <= ? AND last_seen < ?
+	`, endOfDay, liveSince).Scan(&inactive); err != nil {
+		return fmt.Errorf("failed to count inactive: %w", err)
+	}
+
+	var newInstances int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM instances WHERE DATE(first_seen) = ?
+	`, dayStr).Scan(&newInstances); err != nil {
+		return fmt.Errorf("failed to count new instances: %w", err)
+	}
+
+	byType, err := queryBreakdown(ctx, db, `
+		SELECT CASE WHEN server_type IS NULL OR server_type = '' THEN 'unknown' ELSE server_type END, COUNT(*)
+		FROM instances
+		WHERE first_seen <= ? AND last_seen >= ?
+		GROUP BY 1
+	`, endOfDay, liveSince)
+	if err != nil {
+		return fmt.Errorf("failed to compute by-type breakdown: %w", err)
+	}
+
+	byVersion, err := queryBreakdown(ctx, db, `
+		SELECT latest_version, COUNT(*)
+		FROM instances
+		WHERE first_seen <= ? AND last_seen >= ?
+		GROUP BY 1
+	`, endOfDay, liveSince)
+	if err != nil {
+		return fmt.Errorf("failed to compute by-version breakdown: %w", err)
+	}
+
+	byTypeJSON, err := json.Marshal(byType)
+	if err != nil {
+		return fmt.Errorf("failed to marshal by-type breakdown: %w", err)
+	}
+
+	byVersionJSON, err := json.Marshal(byVersion)
+	if err != nil {
+		return fmt.Errorf("failed to marshal by-version breakdown: %w", err)
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO daily_stats (date, total, inactive, new_instances, by_type_json, by_version_json)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, dayStr, total, inactive, newInstances, string(byTypeJSON), string(byVersionJSON))
+	if err != nil {
+		return fmt.Errorf("failed to upsert daily_stats row: %w", err)
+	}
+
+	return nil
+}
+
+func queryBreakdown(ctx context.Context, db *sql.DB, query string, args ...any) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+		counts[key] = count
+	}
+
+	return counts, rows.Err()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"time"
+)
+
+const csvImportBatchSize = 1000
+
+// csvRow is one parsed row of the instances CSV schema: the instances table
+// columns plus an optional checkin_at used to advance last_seen and record a
+// version-history check-in without waiting for the instance to call in again
+// through the normal ingestion path.
+type csvRow struct {
+	id         string
+	firstSeen  time.Time
+	lastSeen   time.Time
+	version    string
+	serverType string
+	checkinAt  sql.NullTime
+}
+
+// ImportInstancesCSV bulk-loads instances (and, when a checkin_at column is
+// present, version-history check-ins) from r. Rows are applied in batches of
+// ~1000 inside a transaction each, using ON CONFLICT DO UPDATE with
+// MAX()/MIN() semantics so re-running an import is idempotent. A malformed
+// timestamp aborts the whole import, reporting the offending CSV line
+// number. Returns the number of rows successfully applied before any error.
+func ImportInstancesCSV(parentCtx context.Context, db *sql.DB, r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, required := range []string{"id", "first_seen", "last_seen", "latest_version"} {
+		if _, ok := columns[required]; !ok {
+			return 0, fmt.Errorf("CSV is missing required column %q", required)
+		}
+	}
+	checkinCol, hasCheckin := columns["checkin_at"]
+	serverTypeCol, hasServerType := columns["server_type"]
+
+	imported := 0
+	batch := make([]csvRow, 0, csvImportBatchSize)
+	lineNum := 1 // the header was line 1
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := importCSVBatch(parentCtx, db, batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		lineNum++
+		if err != nil {
+			return imported, fmt.Errorf("line %d: failed to read CSV row: %w", lineNum, err)
+		}
+		if len(record) != len(header) {
+			return imported, fmt.Errorf("line %d: wrong number of fields: got %d, want %d", lineNum, len(record), len(header))
+		}
+
+		row := csvRow{
+			id:      record[columns["id"]],
+			version: record[columns["latest_version"]],
+		}
+
+		if hasServerType {
+			row.serverType = record[serverTypeCol]
+		}
+
+		row.firstSeen, err = time.Parse(time.RFC3339, record[columns["first_seen"]])
+		if err != nil {
+			return imported, fmt.Errorf("line %d: invalid first_seen timestamp: %w", lineNum, err)
+		}
+
+		row.lastSeen, err = time.Parse(time.RFC3339, record[columns["last_seen"]])
+		if err != nil {
+			return imported, fmt.Errorf("line %d: invalid last_seen timestamp: %w", lineNum, err)
+		}
+
+		if hasCheckin && record[checkinCol] != "" {
+			checkinAt, err := time.Parse(time.RFC3339, record[checkinCol])
+			if err != nil {
+				return imported, fmt.Errorf("line %d: invalid checkin_at timestamp: %w", lineNum, err)
+			}
+			row.checkinAt = sql.NullTime{Time: checkinAt, Valid: true}
+		}
+
+		batch = append(batch, row)
+		if len(batch) >= csvImportBatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return imported, err
+	}
+
+	return imported, nil
+}
+
+func importCSVBatch(parentCtx context.Context, db *sql.DB, batch []csvRow) error {
+	ctx, cancel := context.WithTimeout(parentCtx, 30*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const upsertQuery = `
+	INSERT INTO instances (id, first_seen, last_seen, latest_version, server_type)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		first_seen = MIN(instances.first_seen, excluded.first_seen),
+		last_seen = MAX(instances.last_seen, excluded.last_seen),
+		latest_version = excluded.latest_version,
+		server_type = CASE
+			WHEN excluded.server_type IS NULL OR excluded.server_type = '' THEN instances.server_type
+			ELSE excluded.server_type
+		END
+	`
+
+	for _, row := range batch {
+		lastSeen := row.lastSeen
+		if row.checkinAt.Valid && row.checkinAt.Time.After(lastSeen) {
+			lastSeen = row.checkinAt.Time
+		}
+
+		var currentVersion sql.NullString
+		err := tx.QueryRowContext(ctx, `SELECT latest_version FROM instances WHERE id = ?`, row.id).Scan(&currentVersion)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to look up current version for %s: %w", row.id, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, upsertQuery, row.id, row.firstSeen, lastSeen, row.version, row.serverType); err != nil {
+			return fmt.Errorf("failed to upsert instance %s: %w", row.id, err)
+		}
+
+		// Only a repeated checkin_at column (not a plain re-import of the
+		// same snapshot row) is treated as a new version-history check-in.
+		versionChanged := row.checkinAt.Valid && (!currentVersion.Valid || currentVersion.String != row.version)
+		if versionChanged {
+			// A re-run of the same import finds this row's history entry
+			// already present; skip it so the history isn't duplicated.
+			var recorded bool
+			if err := tx.QueryRowContext(ctx, `
+				SELECT EXISTS(SELECT 1 FROM instance_version_history
+				WHERE instance_id = ? AND version = ? AND first_seen_at = ?)
+			`, row.id, row.version, row.checkinAt.Time).Scan(&recorded); err != nil {
+				return fmt.Errorf("failed to look up version history for %s: %w", row.id, err)
+			}
+			versionChanged = !recorded
+		}
+		if versionChanged {
+			if currentVersion.Valid {
+				if _, err := tx.ExecContext(ctx, `
+					UPDATE instance_version_history
+					SET last_seen_at = ?
+					WHERE instance_id = ? AND last_seen_at IS NULL
+				`, row.checkinAt.Time, row.id); err != nil {
+					return fmt.Errorf("failed to close previous version history row for %s: %w", row.id, err)
+				}
+			}
+
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO instance_version_history (instance_id, version, server_type, first_seen_at, last_seen_at)
+				VALUES (?, ?, ?, ?, NULL)
+			`, row.id, row.version, row.serverType, row.checkinAt.Time); err != nil {
+				return fmt.Errorf("failed to insert version history row for %s: %w", row.id, err)
+			}
+		}
+
+		if row.checkinAt.Valid {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT OR IGNORE INTO instance_checkins (instance_id, day)
+				VALUES (?, ?)
+			`, row.id, row.checkinAt.Time.UTC().Format("2006-01-02")); err != nil {
+				return fmt.Errorf("failed to record check-in for %s: %w", row.id, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ExportInstancesCSV streams the instances table to w as CSV, in the schema
+// ImportInstancesCSV expects, without buffering the whole table in memory.
+// A zero since exports everything; otherwise only instances last seen at or
+// after since are included, for incremental mirroring.
+func ExportInstancesCSV(parentCtx context.Context, db *sql.DB, w io.Writer, since time.Time) error {
+	ctx, cancel := context.WithTimeout(parentCtx, 5*time.Minute)
+	defer cancel()
+
+	query := `SELECT id, first_seen, last_seen, latest_version, server_type FROM instances`
+	var args []any
+	if !since.IsZero() {
+		query += ` WHERE last_seen >= ?`
+		args = append(args, since)
+	}
+	query += ` ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query instances: %w", err)
+	}
+	defer rows.Close()
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"id", "first_seen", "last_seen", "latest_version", "server_type"}); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	for rows.Next() {
+		var id, version, serverType string
+		var firstSeen, lastSeen time.Time
+		if err := rows.Scan(&id, &firstSeen, &lastSeen, &version, &serverType); err != nil {
+			return fmt.Errorf("failed to scan instance row: %w", err)
+		}
+
+		record := []string{
+			id,
+			firstSeen.UTC().Format(time.RFC3339),
+			lastSeen.UTC().Format(time.RFC3339),
+			version,
+			serverType,
+		}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("failed to write CSV row for %s: %w", id, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -4,108 +4,71 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"os"
 	"time"
 
-	_ "github.com/glebarez/go-sqlite"
+	"github.com/getarcaneapp/analytics/storage"
 )
 
+// InstancesStats is the payload served by /stats: the fleet snapshot, the
+// cumulative-count history chart, and the version-adoption chart. Rolling
+// retention windows (R1/R7/R30/R30V2) are served separately by
+// /stats/retention's RetentionStats, so they don't live here too.
 type InstancesStats struct {
-	Total     int                `json:"total"`
-	Inactive  int                `json:"inactive"`
-	ByType    map[string]int     `json:"by_type"`
-	ByVersion map[string]int     `json:"by_version"`
-	History   []InstancesHistory `json:"history"`
+	Total            int                        `json:"total"`
+	Inactive         int                        `json:"inactive"`
+	ByType           map[string]int             `json:"by_type"`
+	ByVersion        map[string]int             `json:"by_version"`
+	History          []storage.InstancesHistory `json:"history"`
+	ByVersionHistory []VersionSpreadPoint       `json:"by_version_history"`
 }
 
-type InstancesHistory struct {
-	Date  string `json:"date"`
-	Count int    `json:"count"`
+// VersionSpreadPoint is the version breakdown of the fleet as of a single
+// bucket boundary (end of day/month), used to chart version adoption over
+// time rather than just the current snapshot.
+type VersionSpreadPoint struct {
+	Date      string         `json:"date"`
+	ByVersion map[string]int `json:"by_version"`
 }
 
-func DoesInstanceExist(parentCtx context.Context, db *sql.DB, instanceID string) (bool, error) {
+// The functions below (version history, retention) still operate directly
+// on a SQLite *sql.DB. They haven't been folded into storage.Store yet, so
+// they're only available when running on the sqlitestore backend; see
+// sqlitestore.Store.DB(). The by-type/by-version historical breakdowns that
+// used to live here have since moved onto storage.Store itself (see
+// Store.GetInstancesByType/GetInstancesByVersion in each backend).
+
+// GetRNActiveInstances implements a Matrix/Dendrite-style RN ("R7", "R30", ...)
+// retention metric: an instance counts as active in the window if it existed
+// for the whole window (first_seen at least `days` old) and it checked in at
+// some point during the window (last_seen within the last `days` days).
+func GetRNActiveInstances(parentCtx context.Context, db *sql.DB, days int) (int, error) {
 	const query = `
-	SELECT EXISTS(SELECT 1 FROM instances WHERE id = ?)
-	`
-
-	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
-	defer cancel()
-	var exists bool
-	err := db.QueryRowContext(ctx, query, instanceID).Scan(&exists)
-	if err != nil {
-		return false, fmt.Errorf("failed to check instance existence: %w", err)
-	}
-
-	return exists, nil
-}
-
-func UpsertInstance(parentCtx context.Context, db *sql.DB, instanceID, version, serverType string) error {
-	now := time.Now()
-
-	// Upsert the instance
-	const query = `
-	INSERT INTO instances (id, first_seen, last_seen, latest_version, server_type)
-	VALUES (?, ?, ?, ?, ?)
-	ON CONFLICT(id) DO UPDATE SET
-		last_seen = excluded.last_seen,
-		latest_version = excluded.latest_version,
-		server_type = CASE
-			WHEN excluded.server_type IS NULL OR excluded.server_type = '' THEN instances.server_type
-			ELSE excluded.server_type
-		END
-	`
-
-	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
-	defer cancel()
-	_, err := db.ExecContext(
-		ctx,
-		query,
-		instanceID, now, now, version, serverType,
-	)
-
-	return err
-}
-
-func GetTotalInstances(parentCtx context.Context, db *sql.DB) (int, error) {
-	// Only count instances that have been active in the last 2 days.
-	const query = `
-	SELECT COUNT(*) 
-	FROM instances 
-	WHERE last_seen >= datetime('now', '-2 days')
-	`
-
-	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
-	defer cancel()
-	var count int
-	err := db.QueryRowContext(ctx, query).Scan(&count)
-	return count, err
-}
-
-func GetInactiveInstances(parentCtx context.Context, db *sql.DB) (int, error) {
-	const query = `
-	SELECT COUNT(*) 
-	FROM instances 
-	WHERE last_seen < datetime('now', '-2 days')
+	SELECT COUNT(*)
+	FROM instances
+	WHERE first_seen <= datetime('now', '-' || ? || ' days')
+	AND last_seen >= datetime('now', '-' || ? || ' days')
 	`
 
 	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
 	defer cancel()
 	var count int
-	err := db.QueryRowContext(ctx, query).Scan(&count)
+	err := db.QueryRowContext(ctx, query, days, days).Scan(&count)
 	return count, err
 }
 
-func GetInstancesByType(parentCtx context.Context, db *sql.DB) (map[string]int, error) {
+// GetRNActiveInstancesByType is GetRNActiveInstances broken down by server type.
+func GetRNActiveInstancesByType(parentCtx context.Context, db *sql.DB, days int) (map[string]int, error) {
 	const query = `
-	SELECT 
-		CASE 
+	SELECT
+		CASE
 			WHEN server_type IS NULL OR server_type = '' THEN 'unknown'
 			ELSE server_type
 		END as server_type,
 		COUNT(*) as count
 	FROM instances
-	WHERE last_seen >= datetime('now', '-2 days')
-	GROUP BY CASE 
+	WHERE first_seen <= datetime('now', '-' || ? || ' days')
+	AND last_seen >= datetime('now', '-' || ? || ' days')
+	GROUP BY CASE
 		WHEN server_type IS NULL OR server_type = '' THEN 'unknown'
 		ELSE server_type
 	END
@@ -113,7 +76,7 @@ func GetInstancesByType(parentCtx context.Context, db *sql.DB) (map[string]int,
 
 	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
 	defer cancel()
-	rows, err := db.QueryContext(ctx, query)
+	rows, err := db.QueryContext(ctx, query, days, days)
 	if err != nil {
 		return nil, err
 	}
@@ -129,26 +92,63 @@ func GetInstancesByType(parentCtx context.Context, db *sql.DB) (map[string]int,
 		counts[serverType] = count
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+	return counts, rows.Err()
+}
 
-	return counts, nil
+// GetRNActiveInstancesV2 tightens GetRNActiveInstances by additionally
+// requiring at least two check-ins spread across the window, so an instance
+// that only happened to be up at both edges of the window doesn't count as
+// retained.
+func GetRNActiveInstancesV2(parentCtx context.Context, db *sql.DB, days int) (int, error) {
+	const query = `
+	SELECT COUNT(*)
+	FROM (
+		SELECT i.id
+		FROM instances i
+		JOIN instance_checkins c ON c.instance_id = i.id
+		WHERE i.first_seen <= datetime('now', '-' || ? || ' days')
+		AND i.last_seen >= datetime('now', '-' || ? || ' days')
+		AND c.day >= date('now', '-' || ? || ' days')
+		GROUP BY i.id
+		HAVING COUNT(DISTINCT c.day) >= 2
+	)
+	`
+
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+	var count int
+	err := db.QueryRowContext(ctx, query, days, days, days).Scan(&count)
+	return count, err
 }
 
-func GetInstancesByVersion(parentCtx context.Context, db *sql.DB) (map[string]int, error) {
+// GetRNActiveInstancesByTypeV2 is GetRNActiveInstancesV2 broken down by server type.
+func GetRNActiveInstancesByTypeV2(parentCtx context.Context, db *sql.DB, days int) (map[string]int, error) {
 	const query = `
-	SELECT 
-		latest_version as version,
+	SELECT
+		CASE
+			WHEN i.server_type IS NULL OR i.server_type = '' THEN 'unknown'
+			ELSE i.server_type
+		END as server_type,
 		COUNT(*) as count
-	FROM instances
-	WHERE last_seen >= datetime('now', '-2 days')
-	GROUP BY latest_version
+	FROM (
+		SELECT i.id, i.server_type
+		FROM instances i
+		JOIN instance_checkins c ON c.instance_id = i.id
+		WHERE i.first_seen <= datetime('now', '-' || ? || ' days')
+		AND i.last_seen >= datetime('now', '-' || ? || ' days')
+		AND c.day >= date('now', '-' || ? || ' days')
+		GROUP BY i.id
+		HAVING COUNT(DISTINCT c.day) >= 2
+	) i
+	GROUP BY CASE
+		WHEN i.server_type IS NULL OR i.server_type = '' THEN 'unknown'
+		ELSE i.server_type
+	END
 	`
 
 	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
 	defer cancel()
-	rows, err := db.QueryContext(ctx, query)
+	rows, err := db.QueryContext(ctx, query, days, days, days)
 	if err != nil {
 		return nil, err
 	}
@@ -156,119 +156,163 @@ func GetInstancesByVersion(parentCtx context.Context, db *sql.DB) (map[string]in
 
 	counts := make(map[string]int)
 	for rows.Next() {
-		var version string
+		var serverType string
 		var count int
-		if err := rows.Scan(&version, &count); err != nil {
+		if err := rows.Scan(&serverType, &count); err != nil {
 			return nil, err
 		}
-		counts[version] = count
+		counts[serverType] = count
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return counts, rows.Err()
+}
+
+// RetentionWindow is the active-instance count for a single rolling window,
+// plus a server-type breakdown of that same count.
+type RetentionWindow struct {
+	Active       int            `json:"active"`
+	ActiveByType map[string]int `json:"active_by_type"`
+}
+
+// RetentionStats is the payload served by /stats/retention.
+type RetentionStats struct {
+	R1    RetentionWindow `json:"r1"`
+	R7    RetentionWindow `json:"r7"`
+	R30   RetentionWindow `json:"r30"`
+	R30V2 RetentionWindow `json:"r30_v2"`
+}
+
+// GetRetentionStats gathers the R1/R7/R30/R30V2 windows in one call for the
+// /stats/retention endpoint.
+func GetRetentionStats(ctx context.Context, db *sql.DB) (*RetentionStats, error) {
+	type window struct {
+		days int
+		v2   bool
+		dest *RetentionWindow
+	}
+
+	stats := &RetentionStats{}
+	windows := []window{
+		{days: 1, dest: &stats.R1},
+		{days: 7, dest: &stats.R7},
+		{days: 30, dest: &stats.R30},
+		{days: 30, v2: true, dest: &stats.R30V2},
 	}
 
-	return counts, nil
+	for _, w := range windows {
+		var active int
+		var byType map[string]int
+		var err error
+
+		if w.v2 {
+			active, err = GetRNActiveInstancesV2(ctx, db, w.days)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get R%d-v2 active instances: %w", w.days, err)
+			}
+			byType, err = GetRNActiveInstancesByTypeV2(ctx, db, w.days)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get R%d-v2 active instances by type: %w", w.days, err)
+			}
+		} else {
+			active, err = GetRNActiveInstances(ctx, db, w.days)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get R%d active instances: %w", w.days, err)
+			}
+			byType, err = GetRNActiveInstancesByType(ctx, db, w.days)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get R%d active instances by type: %w", w.days, err)
+			}
+		}
+
+		w.dest.Active = active
+		w.dest.ActiveByType = byType
+	}
+
+	return stats, nil
 }
 
-func GetInstancesOverTime(parentCtx context.Context, db *sql.DB, timeframe string) ([]InstancesHistory, error) {
-	var query string
+// GetVersionSpreadOverTime buckets the fleet's reported versions by day or
+// month, reading from instance_version_history rather than the current
+// snapshot on instances. For each bucket boundary T it counts the version
+// that was open (first_seen_at <= T AND (last_seen_at IS NULL OR
+// last_seen_at > T)) for every instance, so the dashboard can render a
+// stacked-area chart of version adoption instead of just the latest split.
+func GetVersionSpreadOverTime(parentCtx context.Context, db *sql.DB, timeframe string) ([]VersionSpreadPoint, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+
+	var boundaries []time.Time
+	var dateFormat string
 
 	switch timeframe {
 	case "daily":
-		// Get daily instance counts for the last 30 days
-		// Only include instances that were active in the last 2 days
-		query = `
-		SELECT 
-			DATE(first_seen) as date,
-			COUNT(*) as daily_new,
-			(SELECT COUNT(*) 
-			 FROM instances i2 
-			 WHERE DATE(i2.first_seen) <= DATE(i1.first_seen)
-			 AND i2.last_seen >= datetime('now', '-2 days')) as cumulative_count
-		FROM instances i1
-		WHERE first_seen >= datetime('now', '-30 days')
-		AND last_seen >= datetime('now', '-2 days')
-		GROUP BY DATE(first_seen)
-		ORDER BY date
-		`
+		// One boundary per day for the last 30 days.
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		for i := 29; i >= 0; i-- {
+			boundaries = append(boundaries, today.AddDate(0, 0, -i).Add(24*time.Hour))
+		}
+		dateFormat = "2006-01-02"
 	case "monthly":
-		// Get monthly instance counts for all time
-		// Only include instances that were active in the last 2 days
-		query = `
-		SELECT 
-			strftime('%Y-%m', first_seen) as date,
-			COUNT(*) as monthly_new,
-			(SELECT COUNT(*) 
-			 FROM instances i2 
-			 WHERE strftime('%Y-%m', i2.first_seen) <= strftime('%Y-%m', i1.first_seen)
-			 AND i2.last_seen >= datetime('now', '-2 days')) as cumulative_count
-		FROM instances i1
-		WHERE last_seen >= datetime('now', '-2 days')
-		GROUP BY strftime('%Y-%m', first_seen)
-		ORDER BY date
-		`
+		// One boundary per month, starting at the earliest history row.
+		var earliest sql.NullTime
+		err := db.QueryRowContext(ctx, `SELECT MIN(first_seen_at) FROM instance_version_history`).Scan(&earliest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine earliest history: %w", err)
+		}
+		if !earliest.Valid {
+			return nil, nil
+		}
+
+		start := time.Date(earliest.Time.Year(), earliest.Time.Month(), 1, 0, 0, 0, 0, time.UTC)
+		now := time.Now().UTC()
+		for month := start; !month.After(now); month = month.AddDate(0, 1, 0) {
+			boundaries = append(boundaries, month.AddDate(0, 1, 0))
+		}
+		dateFormat = "2006-01"
 	default:
 		return nil, fmt.Errorf("invalid timeframe: %s. Use 'daily' or 'monthly'", timeframe)
 	}
 
-	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
-	defer cancel()
-	rows, err := db.QueryContext(ctx, query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	chartData := make([]InstancesHistory, 0, 36)
-	for rows.Next() {
-		var date string
-		var newCount, cumulativeCount int
+	const query = `
+	SELECT version, COUNT(*)
+	FROM instance_version_history
+	WHERE first_seen_at <= ?
+	AND (last_seen_at IS NULL OR last_seen_at > ?)
+	GROUP BY version
+	`
 
-		err := rows.Scan(&date, &newCount, &cumulativeCount)
+	points := make([]VersionSpreadPoint, 0, len(boundaries))
+	for _, boundary := range boundaries {
+		byVersion, err := func() (map[string]int, error) {
+			rows, err := db.QueryContext(ctx, query, boundary, boundary)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+
+			byVersion := make(map[string]int)
+			for rows.Next() {
+				var version string
+				var count int
+				if err := rows.Scan(&version, &count); err != nil {
+					return nil, err
+				}
+				byVersion[version] = count
+			}
+
+			return byVersion, rows.Err()
+		}()
 		if err != nil {
 			return nil, err
 		}
 
-		chartData = append(chartData, InstancesHistory{
-			Date:  date,
-			Count: cumulativeCount,
+		// The boundary marks the end of the bucket, so label the point with
+		// the bucket itself rather than the (exclusive) boundary timestamp.
+		points = append(points, VersionSpreadPoint{
+			Date:      boundary.Add(-time.Second).Format(dateFormat),
+			ByVersion: byVersion,
 		})
 	}
 
-	return chartData, nil
-}
-
-func initDB() (*sql.DB, error) {
-	if err := os.MkdirAll("./data", 0755); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %w", err)
-	}
-
-	db, err := sql.Open("sqlite", "./data/pocket-id-analytics.db?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate")
-	if err != nil {
-		return nil, err
-	}
-
-	// Create instances table
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS instances (
-        id TEXT PRIMARY KEY,
-        first_seen DATETIME NOT NULL,
-        last_seen DATETIME NOT NULL,
-        latest_version TEXT NOT NULL,
-        server_type TEXT NOT NULL DEFAULT ''
-    );
-
-    CREATE INDEX IF NOT EXISTS idx_first_seen ON instances(first_seen);
-    CREATE INDEX IF NOT EXISTS idx_last_seen ON instances(last_seen);
-    `
-
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		return nil, err
-	}
-
-	_, _ = db.Exec(`ALTER TABLE instances ADD COLUMN server_type TEXT DEFAULT ''`)
-
-	return db, nil
+	return points, nil
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/getarcaneapp/analytics/storage"
+	"github.com/getarcaneapp/analytics/storage/pgstore"
+)
+
+// statsHandler serves /stats with the fleet snapshot (totals, type/version
+// breakdowns, the instance-count history chart) plus the version-adoption
+// chart. By default the snapshot is live (the current day); pass
+// ?date=YYYY-MM-DD (or RFC3339) to get the by-type/by-version breakdown as
+// of a past day instead, which is served from daily_stats rather than the
+// live instances table. The version-adoption chart still needs direct SQL
+// access (instance_version_history hasn't been folded into storage.Store),
+// so it's only populated when db is non-nil; see the capability check in
+// main.go. The history chart comes back empty rather than failing the
+// whole request on backends (Postgres today) that return
+// pgstore.ErrHistoricalDataUnavailable; a ?date= lookup on such a backend
+// fails the request instead, since that data was explicitly asked for.
+func statsHandler(store storage.Store, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		timeframe := r.URL.Query().Get("timeframe")
+		if timeframe == "" {
+			timeframe = "daily"
+		}
+
+		var date time.Time
+		if dateParam := r.URL.Query().Get("date"); dateParam != "" {
+			var err error
+			date, err = time.Parse(time.RFC3339, dateParam)
+			if err != nil {
+				date, err = time.Parse("2006-01-02", dateParam)
+			}
+			if err != nil {
+				http.Error(w, "invalid date: use RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+		}
+
+		total, err := store.GetTotalInstances(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		inactive, err := store.GetInactiveInstances(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		byType, err := store.GetInstancesByType(ctx, date)
+		if err != nil {
+			if errors.Is(err, pgstore.ErrHistoricalDataUnavailable) {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		byVersion, err := store.GetInstancesByVersion(ctx, date)
+		if err != nil {
+			if errors.Is(err, pgstore.ErrHistoricalDataUnavailable) {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		history, err := store.GetInstancesOverTime(ctx, timeframe)
+		if err != nil && !errors.Is(err, pgstore.ErrHistoricalDataUnavailable) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var byVersionHistory []VersionSpreadPoint
+		if db != nil {
+			byVersionHistory, err = GetVersionSpreadOverTime(ctx, db, timeframe)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		stats := InstancesStats{
+			Total:            total,
+			Inactive:         inactive,
+			ByType:           byType,
+			ByVersion:        byVersion,
+			History:          history,
+			ByVersionHistory: byVersionHistory,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// retentionStatsHandler serves /stats/retention with the R1/R7/R30/R30V2
+// rolling active-instance windows. Retention isn't part of storage.Store
+// yet, so this is only reachable on backends that expose direct SQL access
+// (sqlite today); see the capability check in main.go.
+func retentionStatsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := GetRetentionStats(r.Context(), db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/getarcaneapp/analytics/storage"
+
+	_ "github.com/getarcaneapp/analytics/storage/pgstore"
+	_ "github.com/getarcaneapp/analytics/storage/sqlitestore"
+)
+
+func main() {
+	importCSVPath := flag.String("import-csv", "", "import instances from a CSV file and exit")
+	exportCSVPath := flag.String("export-csv", "", "export instances to a CSV file and exit")
+	since := flag.String("since", "", "with -export-csv, only include instances last seen at or after this RFC3339 timestamp")
+	reaggregateSince := flag.String("reaggregate-since", "", "rebuild daily_stats from this RFC3339 or YYYY-MM-DD date through yesterday, then exit")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	store, err := storage.NewStore(ctx)
+	if err != nil {
+		log.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	rawStore, hasRawSQL := store.(storage.RawSQLStore)
+
+	if *importCSVPath != "" || *exportCSVPath != "" || *reaggregateSince != "" {
+		if !hasRawSQL {
+			log.Fatal("-import-csv, -export-csv, and -reaggregate-since need direct SQL access, which this backend doesn't expose yet (sqlite does; see storage.RawSQLStore)")
+		}
+
+		switch {
+		case *importCSVPath != "":
+			runImportCSV(ctx, rawStore.DB(), *importCSVPath)
+		case *exportCSVPath != "":
+			runExportCSV(ctx, rawStore.DB(), *exportCSVPath, *since)
+		case *reaggregateSince != "":
+			runReaggregate(ctx, rawStore.DB(), *reaggregateSince)
+		}
+
+		return
+	}
+
+	if hasRawSQL {
+		StartDailyAggregation(ctx, rawStore.DB())
+		http.Handle("/stats", statsHandler(store, rawStore.DB()))
+		http.Handle("/stats/retention", retentionStatsHandler(rawStore.DB()))
+	} else {
+		log.Println("backend doesn't expose direct SQL access: daily aggregation, /stats/retention, and the version-adoption chart on /stats are unavailable until it's ported off storage.RawSQLStore")
+		http.Handle("/stats", statsHandler(store, nil))
+	}
+
+	addr := os.Getenv("ANALYTICS_LISTEN_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+
+	log.Printf("analytics service listening on %s", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Fatalf("server failed: %v", err)
+	}
+}
+
+func runImportCSV(ctx context.Context, db *sql.DB, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	imported, err := ImportInstancesCSV(ctx, db, f)
+	if err != nil {
+		log.Fatalf("import failed after %d rows: %v", imported, err)
+	}
+
+	fmt.Printf("imported %d instances from %s\n", imported, path)
+}
+
+func runExportCSV(ctx context.Context, db *sql.DB, path, sinceFlag string) {
+	var since time.Time
+	if sinceFlag != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, sinceFlag)
+		if err != nil {
+			log.Fatalf("invalid -since timestamp: %v", err)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+
+	if err := ExportInstancesCSV(ctx, db, f, since); err != nil {
+		log.Fatalf("export failed: %v", err)
+	}
+
+	fmt.Printf("exported instances to %s\n", path)
+}
+
+func runReaggregate(ctx context.Context, db *sql.DB, sinceFlag string) {
+	since, err := time.Parse(time.RFC3339, sinceFlag)
+	if err != nil {
+		since, err = time.Parse("2006-01-02", sinceFlag)
+	}
+	if err != nil {
+		log.Fatalf("invalid -reaggregate-since date: %v", err)
+	}
+
+	if err := ReaggregateFrom(ctx, db, since); err != nil {
+		log.Fatalf("reaggregate failed: %v", err)
+	}
+
+	fmt.Printf("reaggregated daily_stats from %s\n", since.UTC().Format("2006-01-02"))
+}
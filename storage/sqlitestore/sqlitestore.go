@@ -0,0 +1,409 @@
+// Package sqlitestore is the SQLite implementation of storage.Store.
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/getarcaneapp/analytics/storage"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+func init() {
+	storage.RegisterBackend("sqlite", func(ctx context.Context, path string) (storage.Store, error) {
+		return Open(path)
+	})
+}
+
+type Store struct {
+	db *sql.DB
+}
+
+// DB returns the underlying *sql.DB, for the SQLite-only features (version
+// history, retention, daily aggregation) that haven't been folded into
+// storage.Store yet.
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+// Open opens (and migrates) the SQLite database at path, creating its
+// parent directory if needed.
+func Open(path string) (*Store, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %w", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS instances (
+        id TEXT PRIMARY KEY,
+        first_seen DATETIME NOT NULL,
+        last_seen DATETIME NOT NULL,
+        latest_version TEXT NOT NULL,
+        server_type TEXT NOT NULL DEFAULT ''
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_first_seen ON instances(first_seen);
+    CREATE INDEX IF NOT EXISTS idx_last_seen ON instances(last_seen);
+
+    CREATE TABLE IF NOT EXISTS instance_version_history (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        instance_id TEXT NOT NULL,
+        version TEXT NOT NULL,
+        server_type TEXT NOT NULL DEFAULT '',
+        first_seen_at DATETIME NOT NULL,
+        last_seen_at DATETIME
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_version_history_instance ON instance_version_history(instance_id);
+    CREATE INDEX IF NOT EXISTS idx_version_history_open ON instance_version_history(instance_id, last_seen_at);
+
+    CREATE TABLE IF NOT EXISTS instance_checkins (
+        instance_id TEXT NOT NULL,
+        day TEXT NOT NULL,
+        PRIMARY KEY (instance_id, day)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_checkins_day ON instance_checkins(day);
+
+    CREATE TABLE IF NOT EXISTS daily_stats (
+        date TEXT PRIMARY KEY,
+        total INTEGER NOT NULL,
+        inactive INTEGER NOT NULL,
+        new_instances INTEGER NOT NULL,
+        by_type_json TEXT NOT NULL,
+        by_version_json TEXT NOT NULL
+    );
+    `
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return nil, err
+	}
+
+	_, _ = db.Exec(`ALTER TABLE instances ADD COLUMN server_type TEXT DEFAULT ''`)
+
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) DoesInstanceExist(parentCtx context.Context, instanceID string) (bool, error) {
+	const query = `
+	SELECT EXISTS(SELECT 1 FROM instances WHERE id = ?)
+	`
+
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+	var exists bool
+	err := s.db.QueryRowContext(ctx, query, instanceID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check instance existence: %w", err)
+	}
+
+	return exists, nil
+}
+
+func (s *Store) UpsertInstance(parentCtx context.Context, instanceID, version, serverType string) error {
+	now := time.Now()
+
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var currentVersion sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT latest_version FROM instances WHERE id = ?`, instanceID).Scan(&currentVersion)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to look up current version: %w", err)
+	}
+
+	// Upsert the instance
+	const query = `
+	INSERT INTO instances (id, first_seen, last_seen, latest_version, server_type)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		last_seen = excluded.last_seen,
+		latest_version = excluded.latest_version,
+		server_type = CASE
+			WHEN excluded.server_type IS NULL OR excluded.server_type = '' THEN instances.server_type
+			ELSE excluded.server_type
+		END
+	`
+	if _, err := tx.ExecContext(ctx, query, instanceID, now, now, version, serverType); err != nil {
+		return err
+	}
+
+	// Keep instance_version_history in sync: close off the previous open
+	// row and open a new one whenever the reported version changes.
+	if !currentVersion.Valid || currentVersion.String != version {
+		if currentVersion.Valid {
+			const closeQuery = `
+			UPDATE instance_version_history
+			SET last_seen_at = ?
+			WHERE instance_id = ? AND last_seen_at IS NULL
+			`
+			if _, err := tx.ExecContext(ctx, closeQuery, now, instanceID); err != nil {
+				return fmt.Errorf("failed to close previous version history row: %w", err)
+			}
+		}
+
+		const insertHistoryQuery = `
+		INSERT INTO instance_version_history (instance_id, version, server_type, first_seen_at, last_seen_at)
+		VALUES (?, ?, ?, ?, NULL)
+		`
+		if _, err := tx.ExecContext(ctx, insertHistoryQuery, instanceID, version, serverType, now); err != nil {
+			return fmt.Errorf("failed to insert version history row: %w", err)
+		}
+	}
+
+	// Record today's check-in so R-N-V2 retention can require more than one
+	// check-in spaced across the window, not just presence at the edges.
+	const checkinQuery = `
+	INSERT OR IGNORE INTO instance_checkins (instance_id, day)
+	VALUES (?, ?)
+	`
+	if _, err := tx.ExecContext(ctx, checkinQuery, instanceID, now.UTC().Format("2006-01-02")); err != nil {
+		return fmt.Errorf("failed to record check-in: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) GetTotalInstances(parentCtx context.Context) (int, error) {
+	// Only count instances that have been active in the last 2 days.
+	const query = `
+	SELECT COUNT(*)
+	FROM instances
+	WHERE last_seen >= datetime('now', '-2 days')
+	`
+
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+	var count int
+	err := s.db.QueryRowContext(ctx, query).Scan(&count)
+	return count, err
+}
+
+func (s *Store) GetInactiveInstances(parentCtx context.Context) (int, error) {
+	const query = `
+	SELECT COUNT(*)
+	FROM instances
+	WHERE last_seen < datetime('now', '-2 days')
+	`
+
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+	var count int
+	err := s.db.QueryRowContext(ctx, query).Scan(&count)
+	return count, err
+}
+
+func (s *Store) GetInstancesByType(parentCtx context.Context, date time.Time) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+
+	if isLive(date) {
+		return s.liveInstancesByType(ctx)
+	}
+	return s.dailyStatsBreakdown(ctx, "by_type_json", date)
+}
+
+func (s *Store) GetInstancesByVersion(parentCtx context.Context, date time.Time) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+
+	if isLive(date) {
+		return s.liveInstancesByVersion(ctx)
+	}
+	return s.dailyStatsBreakdown(ctx, "by_version_json", date)
+}
+
+// isLive reports whether date refers to the current, not-yet-summarized UTC
+// day (or is the zero value, meaning "live").
+func isLive(date time.Time) bool {
+	return date.IsZero() || date.UTC().Format("2006-01-02") == time.Now().UTC().Format("2006-01-02")
+}
+
+func (s *Store) liveInstancesByType(ctx context.Context) (map[string]int, error) {
+	const query = `
+	SELECT
+		CASE
+			WHEN server_type IS NULL OR server_type = '' THEN 'unknown'
+			ELSE server_type
+		END as server_type,
+		COUNT(*) as count
+	FROM instances
+	WHERE last_seen >= datetime('now', '-2 days')
+	GROUP BY CASE
+		WHEN server_type IS NULL OR server_type = '' THEN 'unknown'
+		ELSE server_type
+	END
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var serverType string
+		var count int
+		if err := rows.Scan(&serverType, &count); err != nil {
+			return nil, err
+		}
+		counts[serverType] = count
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (s *Store) liveInstancesByVersion(ctx context.Context) (map[string]int, error) {
+	const query = `
+	SELECT
+		latest_version as version,
+		COUNT(*) as count
+	FROM instances
+	WHERE last_seen >= datetime('now', '-2 days')
+	GROUP BY latest_version
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var version string
+		var count int
+		if err := rows.Scan(&version, &count); err != nil {
+			return nil, err
+		}
+		counts[version] = count
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// dailyStatsBreakdown loads a by-type/by-version breakdown for a past UTC
+// day from the column-named JSON column on daily_stats. A day that hasn't
+// been aggregated yet (e.g. before the service started running) yields an
+// empty breakdown rather than an error.
+func (s *Store) dailyStatsBreakdown(ctx context.Context, column string, date time.Time) (map[string]int, error) {
+	dateStr := date.UTC().Format("2006-01-02")
+
+	var raw string
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT %s FROM daily_stats WHERE date = ?`, column), dateStr).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return map[string]int{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s for %s: %w", column, dateStr, err)
+	}
+
+	var counts map[string]int
+	if err := json.Unmarshal([]byte(raw), &counts); err != nil {
+		return nil, fmt.Errorf("failed to parse %s for %s: %w", column, dateStr, err)
+	}
+
+	return counts, nil
+}
+
+func (s *Store) GetInstancesOverTime(parentCtx context.Context, timeframe string) ([]storage.InstancesHistory, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+	defer cancel()
+
+	var query, todayLabel string
+
+	switch timeframe {
+	case "daily":
+		query = `
+		SELECT date, total
+		FROM daily_stats
+		WHERE date >= date('now', '-30 days')
+		ORDER BY date
+		`
+		todayLabel = time.Now().UTC().Format("2006-01-02")
+	case "monthly":
+		query = `
+		SELECT strftime('%Y-%m', date) as bucket, total
+		FROM daily_stats ds
+		WHERE date = (
+			SELECT MAX(date) FROM daily_stats ds2
+			WHERE strftime('%Y-%m', ds2.date) = strftime('%Y-%m', ds.date)
+		)
+		ORDER BY bucket
+		`
+		todayLabel = time.Now().UTC().Format("2006-01")
+	default:
+		return nil, fmt.Errorf("invalid timeframe: %s. Use 'daily' or 'monthly'", timeframe)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	chartData := make([]storage.InstancesHistory, 0, 36)
+	for rows.Next() {
+		var date string
+		var total int
+
+		if err := rows.Scan(&date, &total); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		chartData = append(chartData, storage.InstancesHistory{
+			Date:  date,
+			Count: total,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	rows.Close()
+
+	liveTotal, err := s.GetTotalInstances(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live total for current day: %w", err)
+	}
+
+	if len(chartData) > 0 && chartData[len(chartData)-1].Date == todayLabel {
+		chartData[len(chartData)-1].Count = liveTotal
+	} else {
+		chartData = append(chartData, storage.InstancesHistory{Date: todayLabel, Count: liveTotal})
+	}
+
+	return chartData, nil
+}